@@ -6,13 +6,52 @@ import (
 	"time"
 
 	"github.com/derWhity/flora2influx/device"
+	"github.com/derWhity/flora2influx/output"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
+// validBLEBackends are the BLE backend names accepted by `collection.bleBackend`
+var validBLEBackends = map[string]bool{
+	"":                  true,
+	device.BackendGatt:  true,
+	device.BackendGoBLE: true,
+}
+
+// Collection mode names accepted for `collection.mode`
+const (
+	// CollectionModePush actively fetches readings on a timer and publishes them to an output.Sink
+	CollectionModePush = "push"
+	// CollectionModeScrape polls devices in the background and serves the latest readings from a
+	// Prometheus-compatible `/metrics` HTTP endpoint instead of pushing them anywhere
+	CollectionModeScrape = "scrape"
+)
+
+// validCollectionModes are the collection modes accepted by `collection.mode`
+var validCollectionModes = map[string]bool{
+	"":                   true,
+	CollectionModePush:   true,
+	CollectionModeScrape: true,
+}
+
+// validOutputTypes are the output sink types accepted by `output.type`
+var validOutputTypes = map[string]bool{
+	"":                true,
+	output.TypeInflux: true,
+	output.TypeMQTT:   true,
+}
+
+// validPayloadFormats are the MQTT payload formats accepted by `output.payloadFormat`
+var validPayloadFormats = map[string]bool{
+	"":                             true,
+	output.PayloadFormatGraphite:   true,
+	output.PayloadFormatInfluxLine: true,
+}
+
 // Configuration is the main application configuration file
 type Configuration struct {
 	Influx     InfluxConfig     `yaml:"influx"`
+	Output     OutputConfig     `yaml:"output"`
 	Collection CollectionConfig `yaml:"collection"`
 	Devices    device.ConfigMap `yaml:"devices"`
 }
@@ -40,6 +79,51 @@ func (c *Configuration) Validate() error {
 	if c.Collection.DiscoveryTimeout < time.Second*5 {
 		return fmt.Errorf("Discovery timeout of %s is too low. Please use an interval greater or equal five seconds", c.Collection.Interval)
 	}
+	if !validBLEBackends[c.Collection.BLEBackend] {
+		return fmt.Errorf("Unknown BLE backend %q. Valid values are %q and %q", c.Collection.BLEBackend, device.BackendGatt, device.BackendGoBLE)
+	}
+	if !validCollectionModes[c.Collection.Mode] {
+		return fmt.Errorf("Unknown collection mode %q. Valid values are %q and %q", c.Collection.Mode, CollectionModePush, CollectionModeScrape)
+	}
+	if c.Collection.Mode == CollectionModeScrape && c.Collection.ScrapeAddr == "" {
+		return fmt.Errorf("collection.scrapeAddr must be set when collection.mode is %q", CollectionModeScrape)
+	}
+	if !validOutputTypes[c.Output.Type] {
+		return fmt.Errorf("Unknown output type %q. Valid values are %q and %q", c.Output.Type, output.TypeInflux, output.TypeMQTT)
+	}
+	if c.Output.Type == output.TypeMQTT {
+		if c.Output.BrokerHost == "" {
+			return fmt.Errorf("output.brokerHost must be set when output.type is %q", output.TypeMQTT)
+		}
+		if !validPayloadFormats[c.Output.PayloadFormat] {
+			return fmt.Errorf("Unknown MQTT payload format %q. Valid values are %q and %q", c.Output.PayloadFormat, output.PayloadFormatGraphite, output.PayloadFormatInfluxLine)
+		}
+	}
+	if c.Collection.ReadRetries < 0 {
+		return fmt.Errorf("Read retries cannot be negative")
+	}
+	if c.Collection.StaleAfter < 1 {
+		return fmt.Errorf("Stale-after count of %d is too low. Please use a value greater or equal one", c.Collection.StaleAfter)
+	}
+	if c.Influx.BufferSize < 1 {
+		return fmt.Errorf("Influx buffer size of %d is too low. Please use a value greater or equal one", c.Influx.BufferSize)
+	}
+	// FetchReadings makes ReadRetries+1 attempts, each bounded by ScanTimeout, with an increasing
+	// backoff slept between them - so the real worst case per device is
+	// ScanTimeout*(ReadRetries+1) + MaxReadBackoff(ReadRetries), not just ScanTimeout*ReadRetries.
+	perDeviceBudget := c.Collection.ScanTimeout*time.Duration(c.Collection.ReadRetries+1) + device.MaxReadBackoff(c.Collection.ReadRetries)
+	budget := perDeviceBudget * time.Duration(len(c.Devices))
+	if budget >= c.Collection.Interval {
+		return fmt.Errorf(
+			"Worst-case read time per device (%s, from a scan timeout of %s over %d attempts) * configured devices (%d) is %s, which does not fit into the collection interval of %s. Please raise the interval or lower the timeout/retries",
+			perDeviceBudget,
+			c.Collection.ScanTimeout,
+			c.Collection.ReadRetries+1,
+			len(c.Devices),
+			budget,
+			c.Collection.Interval,
+		)
+	}
 	return nil
 }
 
@@ -55,6 +139,27 @@ type InfluxConfig struct {
 	Database string `yaml:"database"`
 	// The name of the measurement to write into
 	MeasurementName string `yaml:"measurement"`
+	// BufferSize is the number of unsent batches kept in memory across InfluxDB outages
+	BufferSize int `yaml:"bufferSize"`
+}
+
+// OutputConfig configures where collected readings are published to
+type OutputConfig struct {
+	// Type selects the sink readings are published to. One of "influx" or "mqtt", defaulting to
+	// "influx" if left empty
+	Type string `yaml:"type"`
+	// BrokerHost is the host:port of the MQTT broker to publish to. Only used when Type is "mqtt"
+	BrokerHost string `yaml:"brokerHost"`
+	// Optional user name for authentication against the MQTT broker
+	BrokerUser string `yaml:"brokerUser"`
+	// Optional password for authentication against the MQTT broker
+	BrokerPassword string `yaml:"brokerPassword"`
+	// UseTLS connects to the MQTT broker via TLS
+	UseTLS bool `yaml:"useTLS"`
+	// TopicPrefix is prepended to every MQTT topic this application publishes to
+	TopicPrefix string `yaml:"topicPrefix"`
+	// PayloadFormat selects the MQTT message format. One of "graphite" or "influx-line"
+	PayloadFormat string `yaml:"payloadFormat"`
 }
 
 // CollectionConfig configures the data collection options of this application
@@ -67,6 +172,28 @@ type CollectionConfig struct {
 	DiscoveryCooldown time.Duration `yaml:"discoveryCooldown"`
 	// Interval at which the readings are fetched from the discovered device(s)
 	Interval time.Duration `yaml:"interval"`
+	// BLEBackend selects the BLE library used to talk to the devices. One of "gatt" or "go-ble",
+	// defaulting to "gatt" if left empty
+	BLEBackend string `yaml:"bleBackend"`
+	// Mode selects how collected readings leave the application. One of "push" or "scrape",
+	// defaulting to "push" if left empty
+	Mode string `yaml:"mode"`
+	// ScrapeAddr is the "host:port" the `/metrics` HTTP server listens on. Only used when Mode is
+	// "scrape"
+	ScrapeAddr string `yaml:"scrapeAddr"`
+	// ScanTimeout bounds the time budgeted for one full read attempt (connect + read) against a device
+	ScanTimeout time.Duration `yaml:"scanTimeout"`
+	// ConnectTimeout bounds how long establishing the BLE connection to a device may take
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	// ReadTimeout bounds how long reading the sensor data from a device may take once connected
+	ReadTimeout time.Duration `yaml:"readTimeout"`
+	// ReadRetries is the number of additional attempts made after an initial failed read of a device
+	ReadRetries int `yaml:"readRetries"`
+	// MetadataTTL is how long a device's cached firmware/battery metadata is considered valid before
+	// it is read from the device again
+	MetadataTTL time.Duration `yaml:"metadataTTL"`
+	// StaleAfter is the number of consecutive missed reads after which a device is considered stale
+	StaleAfter int `yaml:"staleAfter"`
 }
 
 func getDefaultConfig() *Configuration {
@@ -75,12 +202,26 @@ func getDefaultConfig() *Configuration {
 			Addr:            "http://localhost:8086",
 			Database:        "flora",
 			MeasurementName: "PlantSensors",
+			BufferSize:      10,
+		},
+		Output: OutputConfig{
+			Type:          output.TypeInflux,
+			PayloadFormat: output.PayloadFormatInfluxLine,
 		},
 		Collection: CollectionConfig{
 			DiscoveryInterval: time.Hour,
 			DiscoveryCooldown: time.Second * 30,
 			DiscoveryTimeout:  time.Second * 10,
 			Interval:          time.Minute,
+			BLEBackend:        device.BackendGatt,
+			Mode:              CollectionModePush,
+			ScrapeAddr:        ":9136",
+			ScanTimeout:       time.Second * 15,
+			ConnectTimeout:    time.Second * 10,
+			ReadTimeout:       time.Second * 10,
+			ReadRetries:       2,
+			MetadataTTL:       time.Hour * 24,
+			StaleAfter:        3,
 		},
 	}
 }
@@ -0,0 +1,60 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/derWhity/flora2influx/device/miflora"
+)
+
+// Names of the BLE backends that can be selected via `collection.bleBackend`
+const (
+	// BackendGatt selects the paypal/gatt based implementation
+	BackendGatt = "gatt"
+	// BackendGoBLE selects the go-ble/ble based implementation
+	BackendGoBLE = "go-ble"
+)
+
+// Advertisement is the backend-agnostic representation of a BLE advertisement packet seen during a scan
+type Advertisement struct {
+	// ID uniquely identifies the advertising peripheral (its MAC address on Linux)
+	ID string
+	// Name is the name advertised by the peripheral
+	Name string
+	// RSSI is the received signal strength (in dBm) measured for this advertisement
+	RSSI int
+}
+
+// Peripheral represents an open connection to a single BLE peripheral
+type Peripheral interface {
+	miflora.Peripheral
+	// Close tears down the connection to the peripheral
+	Close() error
+}
+
+// Backend abstracts the underlying BLE library used to scan for and talk to Mi Flora devices.
+// This lets flora2influx switch between BLE stacks (configured via `collection.bleBackend`) without
+// touching the Mi Flora protocol implementation in package miflora.
+//
+// paypal/gatt is unmaintained and can be fragile on modern Linux BlueZ stacks; go-ble/ble works more
+// reliably there and supports context-based timeouts for scanning and connecting
+type Backend interface {
+	// Scan discovers nearby peripherals for the given duration, invoking onAdvertisement for every
+	// advertisement packet received. Scan returns once timeout has elapsed or ctx is cancelled
+	Scan(ctx context.Context, timeout time.Duration, onAdvertisement func(Advertisement)) error
+	// Connect opens a connection to the peripheral identified by id
+	Connect(ctx context.Context, id string) (Peripheral, error)
+}
+
+// NewBackend creates the Backend implementation selected by name. An empty name selects BackendGatt
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "", BackendGatt:
+		return newGattBackend()
+	case BackendGoBLE:
+		return newGoBLEBackend()
+	default:
+		return nil, fmt.Errorf("Unknown BLE backend %q", name)
+	}
+}
@@ -0,0 +1,148 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/derWhity/flora2influx/device/miflora"
+	"github.com/paypal/gatt"
+	"github.com/paypal/gatt/examples/option"
+	"github.com/pkg/errors"
+)
+
+var gattServiceUUID = gatt.MustParseUUID(miflora.ServiceUUID)
+
+// gattBackend implements Backend on top of the unmaintained but still widely deployed paypal/gatt library
+type gattBackend struct {
+	mu          sync.Mutex
+	peripherals map[string]gatt.Peripheral
+}
+
+func newGattBackend() (Backend, error) {
+	return &gattBackend{peripherals: map[string]gatt.Peripheral{}}, nil
+}
+
+// Scan implements Backend
+func (b *gattBackend) Scan(ctx context.Context, timeout time.Duration, onAdvertisement func(Advertisement)) error {
+	btDev, err := gatt.NewDevice(option.DefaultClientOptions...)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create a new GATT device")
+	}
+	btDev.Handle(gatt.PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+		b.mu.Lock()
+		b.peripherals[p.ID()] = p
+		b.mu.Unlock()
+		onAdvertisement(Advertisement{ID: p.ID(), Name: p.Name(), RSSI: rssi})
+	}))
+	btDev.Init(func(d gatt.Device, s gatt.State) {
+		switch s {
+		case gatt.StatePoweredOn:
+			d.Scan([]gatt.UUID{}, false)
+		default:
+			d.StopScanning()
+		}
+	})
+	select {
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+	btDev.StopScanning()
+	return nil
+}
+
+// Connect implements Backend
+func (b *gattBackend) Connect(ctx context.Context, id string) (Peripheral, error) {
+	b.mu.Lock()
+	p, ok := b.peripherals[id]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Peripheral %s was not seen during discovery", id)
+	}
+	connected := make(chan error, 1)
+	conn := &gattConnection{peripheral: p}
+	p.Device().Handle(
+		gatt.PeripheralConnected(func(cp gatt.Peripheral, err error) {
+			conn.conn = cp
+			connected <- err
+		}),
+	)
+	p.Device().Connect(p)
+	select {
+	case err := <-connected:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
+
+// gattConnection implements Peripheral on top of an established paypal/gatt connection
+type gattConnection struct {
+	peripheral gatt.Peripheral
+	conn       gatt.Peripheral
+	chars      map[uint16]*gatt.Characteristic
+}
+
+func (c *gattConnection) characteristic(vHandle uint16) (*gatt.Characteristic, error) {
+	if c.chars == nil {
+		services, err := c.conn.DiscoverServices(nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "Service discovery failed on device")
+		}
+		c.chars = map[uint16]*gatt.Characteristic{}
+		for _, service := range services {
+			if !service.UUID().Equal(gattServiceUUID) {
+				continue
+			}
+			characteristics, err := c.conn.DiscoverCharacteristics(nil, service)
+			if err != nil {
+				return nil, errors.Wrap(err, "Characteristic discovery failed on device")
+			}
+			for _, ch := range characteristics {
+				c.chars[ch.VHandle()] = ch
+			}
+		}
+	}
+	ch, ok := c.chars[vHandle]
+	if !ok {
+		return nil, fmt.Errorf("Characteristic with handle 0x%x not found on device", vHandle)
+	}
+	return ch, nil
+}
+
+// ReadChar implements miflora.Peripheral
+func (c *gattConnection) ReadChar(vHandle uint16) ([]byte, error) {
+	ch, err := c.characteristic(vHandle)
+	if err != nil {
+		return nil, err
+	}
+	return c.conn.ReadCharacteristic(ch)
+}
+
+// ReadLongChar implements miflora.Peripheral
+func (c *gattConnection) ReadLongChar(vHandle uint16) ([]byte, error) {
+	ch, err := c.characteristic(vHandle)
+	if err != nil {
+		return nil, err
+	}
+	return c.conn.ReadLongCharacteristic(ch)
+}
+
+// WriteChar implements miflora.Peripheral
+func (c *gattConnection) WriteChar(vHandle uint16, value []byte, noRsp bool) error {
+	ch, err := c.characteristic(vHandle)
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteCharacteristic(ch, value, noRsp)
+}
+
+// Close implements Peripheral
+func (c *gattConnection) Close() error {
+	c.peripheral.Device().CancelConnection(c.peripheral)
+	return nil
+}
@@ -0,0 +1,112 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/derWhity/flora2influx/device/miflora"
+	"github.com/go-ble/ble"
+	"github.com/go-ble/ble/linux"
+	"github.com/pkg/errors"
+)
+
+var goBLEServiceUUID = ble.MustParse(miflora.ServiceUUID)
+
+// goBLEBackend implements Backend on top of go-ble/ble, which supports context-based scan/connect
+// timeouts and tends to behave more reliably against modern BlueZ stacks than paypal/gatt
+type goBLEBackend struct {
+	device ble.Device
+}
+
+func newGoBLEBackend() (Backend, error) {
+	d, err := linux.NewDevice()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create a new go-ble HCI device")
+	}
+	return &goBLEBackend{device: d}, nil
+}
+
+// Scan implements Backend
+func (b *goBLEBackend) Scan(ctx context.Context, timeout time.Duration, onAdvertisement func(Advertisement)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := b.device.Scan(ctx, true, func(a ble.Advertisement) {
+		onAdvertisement(Advertisement{ID: a.Addr().String(), Name: a.LocalName(), RSSI: a.RSSI()})
+	})
+	if err != nil && errors.Cause(err) != context.DeadlineExceeded && errors.Cause(err) != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+// Connect implements Backend
+func (b *goBLEBackend) Connect(ctx context.Context, id string) (Peripheral, error) {
+	cln, err := b.device.Dial(ctx, ble.NewAddr(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to peripheral")
+	}
+	return &bleConnection{client: cln}, nil
+}
+
+// bleConnection implements Peripheral on top of an established go-ble/ble client connection
+type bleConnection struct {
+	client ble.Client
+	chars  map[uint16]*ble.Characteristic
+}
+
+func (c *bleConnection) characteristic(vHandle uint16) (*ble.Characteristic, error) {
+	if c.chars == nil {
+		services, err := c.client.DiscoverServices([]ble.UUID{goBLEServiceUUID})
+		if err != nil {
+			return nil, errors.Wrap(err, "Service discovery failed on device")
+		}
+		c.chars = map[uint16]*ble.Characteristic{}
+		for _, service := range services {
+			characteristics, err := c.client.DiscoverCharacteristics(nil, service)
+			if err != nil {
+				return nil, errors.Wrap(err, "Characteristic discovery failed on device")
+			}
+			for _, ch := range characteristics {
+				c.chars[ch.ValueHandle] = ch
+			}
+		}
+	}
+	ch, ok := c.chars[vHandle]
+	if !ok {
+		return nil, fmt.Errorf("Characteristic with handle 0x%x not found on device", vHandle)
+	}
+	return ch, nil
+}
+
+// ReadChar implements miflora.Peripheral
+func (c *bleConnection) ReadChar(vHandle uint16) ([]byte, error) {
+	ch, err := c.characteristic(vHandle)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.ReadCharacteristic(ch)
+}
+
+// ReadLongChar implements miflora.Peripheral
+func (c *bleConnection) ReadLongChar(vHandle uint16) ([]byte, error) {
+	ch, err := c.characteristic(vHandle)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.ReadLongCharacteristic(ch)
+}
+
+// WriteChar implements miflora.Peripheral
+func (c *bleConnection) WriteChar(vHandle uint16, value []byte, noRsp bool) error {
+	ch, err := c.characteristic(vHandle)
+	if err != nil {
+		return err
+	}
+	return c.client.WriteCharacteristic(ch, value, noRsp)
+}
+
+// Close implements Peripheral
+func (c *bleConnection) Close() error {
+	return c.client.CancelConnection()
+}
@@ -1,70 +1,69 @@
 package device
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"time"
 
-	"github.com/paypal/gatt"
-	"github.com/paypal/gatt/examples/option"
-	"github.com/sirupsen/logrus"
+	"github.com/derWhity/flora2influx/device/miflora"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+// RetryBackoffStep is the amount of extra delay added before each successive read retry
+const RetryBackoffStep = 500 * time.Millisecond
+
+// RetryBackoffMax caps the delay between read retries
+const RetryBackoffMax = 5 * time.Second
+
+// MaxReadBackoff returns the total time FetchReadings spends sleeping between attempts for a
+// RetryPolicy with the given number of retries, i.e. the sum of the increasing per-attempt backoff
+// capped at RetryBackoffMax
+func MaxReadBackoff(retries int) time.Duration {
+	var total time.Duration
+	for attempt := 1; attempt <= retries; attempt++ {
+		backoff := time.Duration(attempt) * RetryBackoffStep
+		if backoff > RetryBackoffMax {
+			backoff = RetryBackoffMax
+		}
+		total += backoff
+	}
+	return total
+}
+
 const (
 	fldDevice = "device"
 	fldAlias  = "alias"
-	// VHandle of the realtime data switching characteristic. You need to write 0xA01F to this in order to start
-	// the real-time data mode. Otherwise, the sensor readings will return a static value
-	vHandleRealtimeData = 0x33
-	// VHandle of the firmware and battery characteristic.
-	// Firmware version and battery charge (in %) can be read from here
-	vHandleFirmwareAndBattery = 0x38
-	// VHandle of the sensor readings characteristic.
-	// Reading from this provides current temperature, light intensity, moisture and fertility readings
-	vHandleSensorReadings = 0x35
-
-	//-- Influx value names
-
-	keyBatteryLevel = "battery"
-	keyTemperature  = "temperature"
-	keyMoisture     = "moisture"
-	keyConductivity = "conductivity"
-	keyLight        = "light"
 )
 
-var (
-	// Device names the MiFlora device is known to identify with
-	floraDeviceNames = map[string]int{
-		"Flower care": 1,
-		"Flower mate": 1,
-	}
-	// The UUID of the service that holds all three characteristics we need to retrieve data
-	floraServiceUUID = gatt.MustParseUUID("0000120400001000800000805f9b34fb")
-)
+// floraDeviceNames names the MiFlora device is known to identify with
+var floraDeviceNames = map[string]int{
+	"Flower care": 1,
+	"Flower mate": 1,
+}
 
-// Discover runs a discovery on the local network for routers providing the service
-// "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1" via UPnP and returns a list
-// of all of those devices found
+// Discover runs a scan for nearby devices using the given BLE backend and returns a list of all
+// Mi Flora devices found
 //
-// The scanning will happen for the time-range given in `timeout` before it will stop
-// automatically
-func Discover(timeout time.Duration, confMap ConfigMap, logger *logrus.Entry) ([]*Device, error) {
+// The scanning will happen for the time-range given in `timeout` before it will stop automatically
+func Discover(ctx context.Context, backend Backend, timeout time.Duration, confMap ConfigMap, metadataCache *MetadataCache, logger *logrus.Entry) ([]*Device, error) {
 	logger.Info("Discovering Bluetooth devices in the vincinity...")
 	out := []*Device{}
-	btDev, err := gatt.NewDevice(option.DefaultClientOptions...)
-	if err != nil {
-		logger.WithError(err).Error("Failed to create a new GATT device")
-		return errors.Wrap(err, "Failed to create a new GATT device")
-	}
-	btDev.Handle(gatt.PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
-		if _, ok := floraDeviceNames[p.Name()]; ok {
+	seen := map[string]bool{}
+	err := backend.Scan(ctx, timeout, func(a Advertisement) {
+		if _, ok := floraDeviceNames[a.Name]; ok {
+			if seen[a.ID] {
+				return
+			}
+			seen[a.ID] = true
 			dev := &Device{
-				Logger:     logger.WithField(fldDevice, p.ID()),
-				peripheral: p,
+				Logger:        logger.WithField(fldDevice, a.ID),
+				id:            a.ID,
+				backend:       backend,
+				rssi:          a.RSSI,
+				metadataCache: metadataCache,
 			}
-			if conf, ok := confMap[p.ID()]; ok {
+			if conf, ok := confMap[a.ID]; ok {
 				if conf.Ignore {
 					dev.Logger.Infof("Device will be ignored")
 					return
@@ -77,73 +76,43 @@ func Discover(timeout time.Duration, confMap ConfigMap, logger *logrus.Entry) ([
 			dev.Logger.Info("Flora device detected")
 			out = append(out, dev)
 		}
-	}))
-	btDev.Init(func(d gatt.Device, s gatt.State) {
-		logger.Infof("Device state changed to '%s'", s)
-		switch s {
-		case gatt.StatePoweredOn:
-			logger.Info("Device is up. Scan is starting...")
-			d.Scan([]gatt.UUID{}, false)
-			return
-		default:
-			d.StopScanning()
-		}
 	})
-	time.Sleep(timeout)
-	logger.Infof("Stopping the scan after %s", timeout)
-	btDev.StopScanning()
-	return out, nil
-}
-
-// Readings represents one set of readings received from the Flora device
-type Readings struct {
-	// Version string of the firmware
-	FirmwareVersion string
-	// Battery level in percent
-	BatteryLevel uint8
-	// Temperature in °C
-	Temperature float64
-	// Moisture in percent
-	Moisture byte
-	// Light in lumens
-	Light uint16
-	// Conductivity in µS/cm
-	Conductivity uint16
-}
-
-func (r *Readings) String() string {
-	return fmt.Sprintf(
-		"[ 🔋 %d | 🌡  %.1f°C | 💧 %d%% | 💡 %d lm | ⚡️ %d µS/cm | v%s ]",
-		r.BatteryLevel,
-		r.Temperature,
-		r.Moisture,
-		r.Light,
-		r.Conductivity,
-		r.FirmwareVersion,
-	)
-}
-
-// ToInfluxValues returns the reading values as influx field values
-func (r *Readings) ToInfluxValues() map[string]interface{} {
-	return map[string]interface{}{
-		keyBatteryLevel: r.BatteryLevel,
-		keyTemperature:  r.Temperature,
-		keyMoisture:     r.Moisture,
-		keyConductivity: r.Conductivity,
-		keyLight:        r.Light,
+	if err != nil {
+		logger.WithError(err).Error("Device discovery failed")
+		return nil, errors.Wrap(err, "Failed to scan for devices")
 	}
+	return out, nil
 }
 
-// Device represents a router device found during discovery
+// Device represents a Mi Flora device found during discovery
 type Device struct {
-	// The peripheral found
-	peripheral gatt.Peripheral
-	// Logger entry that is preconfigured with fields identifying the router
+	// id is the peripheral's MAC address, used to re-connect to it via the backend
+	id string
+	// backend is the BLE backend used to talk to the device
+	backend Backend
+	// rssi is the signal strength measured for the advertisement this device was discovered with
+	rssi int
+	// metadataCache caches the firmware/battery metadata across collection ticks
+	metadataCache *MetadataCache
+	// Logger entry that is preconfigured with fields identifying the device
 	Logger *logrus.Entry
 	// The alias if configured
 	Alias string
 }
 
+// RetryPolicy controls the timeouts and retry behavior Device.FetchReadings applies to a single
+// read cycle
+type RetryPolicy struct {
+	// ScanTimeout bounds the time budgeted for one full read attempt (connect + read)
+	ScanTimeout time.Duration
+	// ConnectTimeout bounds how long establishing the BLE connection may take
+	ConnectTimeout time.Duration
+	// ReadTimeout bounds how long reading the sensor data may take once connected
+	ReadTimeout time.Duration
+	// Retries is the number of additional attempts made after an initial failed read
+	Retries int
+}
+
 // GetName returns the device's alias or MAC address - depending on what is available
 func (dev *Device) GetName() string {
 	if dev.Alias != "" {
@@ -154,134 +123,118 @@ func (dev *Device) GetName() string {
 
 // GetID returns the device's MAC address (ID)
 func (dev *Device) GetID() string {
-	return dev.peripheral.ID()
+	return dev.id
 }
 
-// FetchReadings tries to fetch the current readings from the device
-func (dev *Device) FetchReadings() (*Readings, error) {
-	var errOut error
-	var out *Readings
+// FetchReadings connects to the device via its backend and retrieves the current sensor readings,
+// retrying with an increasing backoff on transient BLE errors as configured in policy
+func (dev *Device) FetchReadings(ctx context.Context, policy RetryPolicy) (*miflora.Readings, error) {
 	dev.Logger.Info("Fetching readings from device")
-	done := make(chan bool)
-	dev.peripheral.Device().Handle(
-		gatt.PeripheralConnected(func(p gatt.Peripheral, err error) {
-			defer p.Device().CancelConnection(p)
-			dev.Logger.Debug("Connection to device established")
-			services, err := p.DiscoverServices(nil)
-			if err != nil {
-				dev.Logger.WithError(err).Error("Service disvovery failed on device")
-				return
-			}
-			var cFirmware *gatt.Characteristic
-			var cReadings *gatt.Characteristic
-			var cRealtimeData *gatt.Characteristic
-			for _, service := range services {
-				if service.UUID().Equal(floraServiceUUID) {
-					dev.Logger.Debugf("Found sensor data service on device (%s)", floraServiceUUID)
-					characteristics, err := p.DiscoverCharacteristics(nil, service)
-					if err != nil {
-						dev.Logger.WithError(err).Error("Characteristics disvovery failed on device")
-						errOut = err
-						return
-					}
-					for _, characteristic := range characteristics {
-						switch characteristic.VHandle() {
-						case vHandleRealtimeData:
-							cRealtimeData = characteristic
-							dev.Logger.Debugf("Found realtime data switch characteristic (0x%x)", characteristic.VHandle())
-						case vHandleSensorReadings:
-							cReadings = characteristic
-							dev.Logger.Debugf("Found sensor reading characteristic (0x%x)", characteristic.VHandle())
-						case vHandleFirmwareAndBattery:
-							cFirmware = characteristic
-							dev.Logger.Debugf("Found firmware and battery data characteristic (0x%x)", characteristic.VHandle())
-						}
-					}
-				}
-			}
-			if cFirmware == nil {
-				dev.Logger.Error("No firmware characteristic found. Aborting query.")
-				errOut = fmt.Errorf("No firmware and battery characteristic found on device")
-				return
-			}
-			// Get the firmware version in order to determine if we need to enable real-time data beforehand
-			rd := &Readings{}
-			data, err := p.ReadCharacteristic(cFirmware)
-			if err != nil {
-				dev.Logger.WithError(err).Error("Failed reading firmware data")
-				errOut = err
-				return
-			}
-			decodeFirmwareData(data, rd)
-			dev.Logger.Debugf("Firmware version: %s - Battery at %d%%", rd.FirmwareVersion, rd.BatteryLevel)
-
-			// For firmware later than 2.6.6 we need to enable realtime data read in order to get any sensor data
-			if rd.FirmwareVersion > "2.6.6" {
-				if cRealtimeData == nil {
-					dev.Logger.Error("No realtime data switch characteristic dicovered. Sensor will not return proper data - aborting.")
-					errOut = fmt.Errorf("Realtime data switch characteristic not found")
-					return
-				}
-				if err := p.WriteCharacteristic(cRealtimeData, []byte{0xa0, 0xaf}, false); err != nil {
-					dev.Logger.WithError(err).Error("Failed to enable realtime data reading")
-					errOut = err
-					return
-				}
-				dev.Logger.Debug("Realtime data reading enabled on device")
+	maxAttempts := policy.Retries + 1
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		readings, connectDuration, readDuration, err := dev.fetchOnce(ctx, policy)
+		if err == nil {
+			readings.RSSI = dev.rssi
+			readings.ConnectDurationMs = connectDuration.Milliseconds()
+			readings.ReadoutDurationMs = readDuration.Milliseconds()
+			readings.AttemptCount = attempt
+			return readings, nil
+		}
+		lastErr = err
+		if attempt < maxAttempts {
+			backoff := time.Duration(attempt) * RetryBackoffStep
+			if backoff > RetryBackoffMax {
+				backoff = RetryBackoffMax
 			}
+			dev.Logger.WithError(err).Warnf("Read attempt %d/%d failed. Retrying in %s", attempt, maxAttempts, backoff)
+			time.Sleep(backoff)
+		}
+	}
+	return nil, errors.Wrap(lastErr, "All read attempts failed")
+}
 
-			if cReadings == nil {
-				dev.Logger.Error("No readings characteristic discovered. Unable to read sensor data.")
-				errOut = fmt.Errorf("No readings characteristic discovered on device")
-				return
-			}
+// fetchOnce performs a single connect-and-read cycle, bounded by the timeouts in policy, and
+// reports back how long connecting and reading took
+func (dev *Device) fetchOnce(ctx context.Context, policy RetryPolicy) (*miflora.Readings, time.Duration, time.Duration, error) {
+	attemptCtx := ctx
+	if policy.ScanTimeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, policy.ScanTimeout)
+		defer cancel()
+	}
+	connectCtx := attemptCtx
+	if policy.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		connectCtx, cancel = context.WithTimeout(attemptCtx, policy.ConnectTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	conn, err := dev.backend.Connect(connectCtx, dev.id)
+	connectDuration := time.Since(start)
+	if err != nil {
+		return nil, connectDuration, 0, errors.Wrap(err, "Failed to connect to device")
+	}
+	defer conn.Close()
 
-			data, err = p.ReadLongCharacteristic(cReadings)
-			if err != nil {
-				dev.Logger.WithError(err).Error("Failed reading sensor data")
-				errOut = err
-				return
-			}
-			decodeSensorData(data, rd)
-			out = rd
-		}),
-		gatt.PeripheralDisconnected(func(p gatt.Peripheral, err error) {
-			dev.Logger.Debug("Disconnected from device")
-			close(done)
-		}),
-	)
-	dev.peripheral.Device().Connect(dev.peripheral)
-	<-done
-	return out, errOut
+	start = time.Now()
+	readings, err := readWithTimeout(attemptCtx, policy.ReadTimeout, func() (*miflora.Readings, error) {
+		return dev.readAll(conn)
+	})
+	readDuration := time.Since(start)
+	if err != nil {
+		return nil, connectDuration, readDuration, err
+	}
+	return readings, connectDuration, readDuration, nil
 }
 
-func decodeFirmwareData(data []byte, rd *Readings) {
-	buf := bytes.NewBuffer(data)
-	var batt uint8
-	binary.Read(buf, binary.LittleEndian, &batt)
-	rd.BatteryLevel = batt
-	buf.Next(1)
-	// The rest is the version string
-	rd.FirmwareVersion = buf.String()
+// readAll retrieves a full set of readings from conn, serving the firmware/battery metadata from
+// dev.metadataCache when a still-valid entry exists instead of reading it from the device
+func (dev *Device) readAll(conn Peripheral) (*miflora.Readings, error) {
+	md, ok := dev.metadataCache.Get(dev.id)
+	if !ok {
+		dev.Logger.Debug("Metadata cache miss or expired - reading firmware and battery data")
+		fresh, err := miflora.FetchMetadata(conn)
+		if err != nil {
+			return nil, err
+		}
+		md = *fresh
+		dev.metadataCache.Set(dev.id, md)
+	}
+	dev.Logger.Debugf("Firmware version: %s - Battery at %d%%", md.FirmwareVersion, md.BatteryLevel)
+	readings, err := miflora.FetchSensorReadings(conn, md.FirmwareVersion, dev.Logger)
+	if err != nil {
+		return nil, err
+	}
+	readings.FirmwareVersion = md.FirmwareVersion
+	readings.BatteryLevel = md.BatteryLevel
+	return readings, nil
 }
 
-func decodeSensorData(data []byte, rd *Readings) {
-	p := bytes.NewBuffer(data)
-	var t int16
-	var m uint8
-	var l, c uint16
-
-	// Data format: TT TT ?? LL LL ?? ?? MM CC CC
-	//             |Temp |  |Light|     |⬇︎| Conductivity
-	//                                Moisture
-	binary.Read(p, binary.LittleEndian, &t)
-	rd.Temperature = float64(t) / 10
-	p.Next(1)
-	binary.Read(p, binary.LittleEndian, &l)
-	rd.Light = l
-	p.Next(2)
-	binary.Read(p, binary.LittleEndian, &m)
-	rd.Moisture = m
-	binary.Read(p, binary.LittleEndian, &c)
-	rd.Conductivity = c
+// readWithTimeout runs fetch, aborting with an error if it has not finished within timeout or ctx
+// is cancelled beforehand
+func readWithTimeout(ctx context.Context, timeout time.Duration, fetch func() (*miflora.Readings, error)) (*miflora.Readings, error) {
+	type result struct {
+		readings *miflora.Readings
+		err      error
+	}
+	resChan := make(chan result, 1)
+	go func() {
+		readings, err := fetch()
+		resChan <- result{readings, err}
+	}()
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+	select {
+	case res := <-resChan:
+		return res.readings, res.err
+	case <-timeoutChan:
+		return nil, fmt.Errorf("Timed out after %s while reading sensor data", timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
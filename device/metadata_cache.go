@@ -0,0 +1,44 @@
+package device
+
+import (
+	"sync"
+	"time"
+
+	"github.com/derWhity/flora2influx/device/miflora"
+)
+
+// MetadataCache caches each device's rarely-changing metadata (firmware version, battery level)
+// for up to a configurable TTL, so FetchReadings does not have to read it on every collection tick
+type MetadataCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]metadataCacheEntry
+}
+
+type metadataCacheEntry struct {
+	metadata  miflora.Metadata
+	expiresAt time.Time
+}
+
+// NewMetadataCache creates a MetadataCache whose entries stay valid for ttl after being set
+func NewMetadataCache(ttl time.Duration) *MetadataCache {
+	return &MetadataCache{ttl: ttl, entries: map[string]metadataCacheEntry{}}
+}
+
+// Get returns the cached metadata for id, if an entry exists and has not yet expired
+func (c *MetadataCache) Get(id string) (miflora.Metadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return miflora.Metadata{}, false
+	}
+	return entry.metadata, true
+}
+
+// Set stores metadata for id, valid for the cache's TTL starting now
+func (c *MetadataCache) Set(id string, metadata miflora.Metadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = metadataCacheEntry{metadata: metadata, expiresAt: time.Now().Add(c.ttl)}
+}
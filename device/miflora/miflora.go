@@ -0,0 +1,178 @@
+// Package miflora implements the Xiaomi Mi Flora / Flower Care BLE protocol: the GATT service
+// and characteristic layout, the realtime-mode switch and the binary decoding of the sensor
+// values. It is intentionally kept independent of any particular BLE library so it can be shared
+// by every device.Backend implementation
+package miflora
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ServiceUUID is the UUID of the GATT service that holds all three characteristics needed to
+	// retrieve data from a Mi Flora device
+	ServiceUUID = "0000120400001000800000805f9b34fb"
+
+	// VHandleRealtimeData is the VHandle of the realtime data switching characteristic. You need to
+	// write 0xA01F to this in order to start the real-time data mode. Otherwise, the sensor readings
+	// will return a static value
+	VHandleRealtimeData uint16 = 0x33
+	// VHandleFirmwareAndBattery is the VHandle of the firmware and battery characteristic.
+	// Firmware version and battery charge (in %) can be read from here
+	VHandleFirmwareAndBattery uint16 = 0x38
+	// VHandleSensorReadings is the VHandle of the sensor readings characteristic.
+	// Reading from this provides current temperature, light intensity, moisture and fertility readings
+	VHandleSensorReadings uint16 = 0x35
+
+	//-- Influx value names
+
+	keyBatteryLevel      = "battery"
+	keyTemperature       = "temperature"
+	keyMoisture          = "moisture"
+	keyConductivity      = "conductivity"
+	keyLight             = "light"
+	keyRSSI              = "rssi"
+	keyConnectDurationMs = "connect_duration_ms"
+	keyReadoutDurationMs = "readout_duration_ms"
+	keyAttemptCount      = "attempt_count"
+)
+
+// Peripheral is the minimal set of GATT operations the Mi Flora protocol needs from an
+// already-connected peripheral. Every device.Backend implements this on top of its underlying
+// BLE library so the protocol below stays backend-agnostic
+type Peripheral interface {
+	// ReadChar reads the current value of the characteristic identified by vHandle
+	ReadChar(vHandle uint16) ([]byte, error)
+	// ReadLongChar reads the current value of a characteristic whose value may span more than one packet
+	ReadLongChar(vHandle uint16) ([]byte, error)
+	// WriteChar writes value to the characteristic identified by vHandle
+	WriteChar(vHandle uint16, value []byte, noRsp bool) error
+}
+
+// Readings represents one set of readings received from the Flora device
+type Readings struct {
+	// Version string of the firmware
+	FirmwareVersion string
+	// Battery level in percent
+	BatteryLevel uint8
+	// Temperature in °C
+	Temperature float64
+	// Moisture in percent
+	Moisture byte
+	// Light intensity in lux
+	Light uint16
+	// Conductivity in µS/cm
+	Conductivity uint16
+	// RSSI is the signal strength (in dBm) measured for the advertisement that led to this device
+	// being discovered
+	RSSI int
+	// ConnectDurationMs is how long establishing the BLE connection for this read took, in milliseconds
+	ConnectDurationMs int64
+	// ReadoutDurationMs is how long reading the sensor data took once connected, in milliseconds
+	ReadoutDurationMs int64
+	// AttemptCount is the number of attempts (including retries) it took to obtain this reading
+	AttemptCount int
+}
+
+func (r *Readings) String() string {
+	return fmt.Sprintf(
+		"[ 🔋 %d | 🌡  %.1f°C | 💧 %d%% | 💡 %d lx | ⚡️ %d µS/cm | v%s ]",
+		r.BatteryLevel,
+		r.Temperature,
+		r.Moisture,
+		r.Light,
+		r.Conductivity,
+		r.FirmwareVersion,
+	)
+}
+
+// ToInfluxValues returns the reading values as influx field values
+func (r *Readings) ToInfluxValues() map[string]interface{} {
+	return map[string]interface{}{
+		keyBatteryLevel:      r.BatteryLevel,
+		keyTemperature:       r.Temperature,
+		keyMoisture:          r.Moisture,
+		keyConductivity:      r.Conductivity,
+		keyLight:             r.Light,
+		keyRSSI:              r.RSSI,
+		keyConnectDurationMs: r.ConnectDurationMs,
+		keyReadoutDurationMs: r.ReadoutDurationMs,
+		keyAttemptCount:      r.AttemptCount,
+	}
+}
+
+// Metadata holds the Mi Flora device properties that rarely change and can therefore be cached
+// between reads instead of being fetched on every collection tick
+type Metadata struct {
+	// Version string of the firmware
+	FirmwareVersion string
+	// Battery level in percent
+	BatteryLevel uint8
+}
+
+// FetchMetadata reads the firmware version and battery level from an already-connected peripheral
+func FetchMetadata(p Peripheral) (*Metadata, error) {
+	data, err := p.ReadChar(VHandleFirmwareAndBattery)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed reading firmware data")
+	}
+	md := &Metadata{}
+	decodeFirmwareData(data, md)
+	return md, nil
+}
+
+// FetchSensorReadings reads the current sensor values from an already-connected peripheral.
+// Firmware later than 2.6.6 only returns live sensor data after the realtime data mode has been
+// switched on, so the device's firmwareVersion (see FetchMetadata) decides whether that switch is
+// necessary
+func FetchSensorReadings(p Peripheral, firmwareVersion string, logger *logrus.Entry) (*Readings, error) {
+	if firmwareVersion > "2.6.6" {
+		if err := p.WriteChar(VHandleRealtimeData, []byte{0xa0, 0x1f}, false); err != nil {
+			return nil, errors.Wrap(err, "Failed to enable realtime data reading")
+		}
+		logger.Debug("Realtime data reading enabled on device")
+	}
+	data, err := p.ReadLongChar(VHandleSensorReadings)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed reading sensor data")
+	}
+	rd := &Readings{}
+	decodeSensorData(data, rd)
+	return rd, nil
+}
+
+func decodeFirmwareData(data []byte, md *Metadata) {
+	buf := bytes.NewBuffer(data)
+	var batt uint8
+	binary.Read(buf, binary.LittleEndian, &batt)
+	md.BatteryLevel = batt
+	buf.Next(1)
+	// The rest is the version string
+	md.FirmwareVersion = buf.String()
+}
+
+func decodeSensorData(data []byte, rd *Readings) {
+	p := bytes.NewBuffer(data)
+	var t int16
+	var m uint8
+	var l, c uint16
+
+	// Data format: TT TT ?? LL LL ?? ?? MM CC CC
+	//             |Temp |  |Light|     |⬇︎| Conductivity
+	//                                Moisture
+	binary.Read(p, binary.LittleEndian, &t)
+	rd.Temperature = float64(t) / 10
+	p.Next(1)
+	binary.Read(p, binary.LittleEndian, &l)
+	rd.Light = l
+	p.Next(2)
+	binary.Read(p, binary.LittleEndian, &m)
+	rd.Moisture = m
+	binary.Read(p, binary.LittleEndian, &c)
+	rd.Conductivity = c
+}
@@ -0,0 +1,71 @@
+package device
+
+import (
+	"context"
+	"time"
+
+	"github.com/derWhity/flora2influx/device/miflora"
+)
+
+// Result is what Scheduler.RunOnce reports back for a single device's read attempt
+type Result struct {
+	// Device is the device the attempt was made against
+	Device *Device
+	// Readings holds the fetched values, if the attempt succeeded
+	Readings *miflora.Readings
+	// Err holds the error returned by the attempt, if it failed
+	Err error
+	// Stale is true once the device has missed StaleAfter consecutive reads in a row
+	Stale bool
+}
+
+// Scheduler reads a fixed set of devices sequentially - concurrent connections typically fail on
+// a single BLE adapter - but spreads the reads evenly across the collection interval instead of
+// bursting them all at once, and tracks consecutive read failures per device so disappeared
+// sensors can be flagged as stale
+type Scheduler struct {
+	devices     []*Device
+	policy      RetryPolicy
+	interval    time.Duration
+	staleAfter  int
+	missedReads map[string]int
+}
+
+// NewScheduler creates a Scheduler for devices, reading each of them with policy, spacing attempts
+// evenly across interval, and flagging a device as stale after staleAfter consecutive missed reads
+func NewScheduler(devices []*Device, policy RetryPolicy, interval time.Duration, staleAfter int) *Scheduler {
+	return &Scheduler{
+		devices:     devices,
+		policy:      policy,
+		interval:    interval,
+		staleAfter:  staleAfter,
+		missedReads: map[string]int{},
+	}
+}
+
+// RunOnce reads every device exactly once, sequentially, spacing attempts evenly across the
+// scheduler's interval, and calls onResult after each one. It returns early if ctx is cancelled
+func (s *Scheduler) RunOnce(ctx context.Context, onResult func(Result)) {
+	if len(s.devices) == 0 {
+		return
+	}
+	slot := s.interval / time.Duration(len(s.devices))
+	for i, dev := range s.devices {
+		if i > 0 {
+			select {
+			case <-time.After(slot):
+			case <-ctx.Done():
+				return
+			}
+		}
+		readings, err := dev.FetchReadings(ctx, s.policy)
+		stale := false
+		if err != nil {
+			s.missedReads[dev.id]++
+			stale = s.missedReads[dev.id] >= s.staleAfter
+		} else {
+			s.missedReads[dev.id] = 0
+		}
+		onResult(Result{Device: dev, Readings: readings, Err: err, Stale: stale})
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/derWhity/flora2influx/device"
-	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/derWhity/flora2influx/metrics"
+	"github.com/derWhity/flora2influx/output"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
@@ -24,8 +27,13 @@ const (
 	tagFirmwareVersion = "version"
 )
 
-func discoverAndRun(errChan chan error, config *Configuration, influxClient client.Client, logger *logrus.Entry) {
-	devices, err := device.Discover(config.Collection.DiscoveryTimeout, logger)
+// discoverAndRun discovers the devices to collect from and then reads them on every collection
+// tick until DiscoveryInterval has passed, handing each device's outcome to onResult and, once
+// every device has been handled, calling onFlush - if set - to let the caller push out anything it
+// only collects rather than acts on immediately
+func discoverAndRun(errChan chan error, config *Configuration, backend device.Backend, metadataCache *device.MetadataCache, onResult func(device.Result), onFlush func(context.Context) error, logger *logrus.Entry) {
+	ctx := context.Background()
+	devices, err := device.Discover(ctx, backend, config.Collection.DiscoveryTimeout, config.Devices, metadataCache, logger)
 	if err != nil {
 		logger.WithError(err).Error("Device discovery failed")
 		errChan <- err
@@ -36,51 +44,23 @@ func discoverAndRun(errChan chan error, config *Configuration, influxClient clie
 		devStr = "device"
 	}
 	logger.Infof("Scan finished. %d %s found", len(devices), devStr)
+	retryPolicy := device.RetryPolicy{
+		ScanTimeout:    config.Collection.ScanTimeout,
+		ConnectTimeout: config.Collection.ConnectTimeout,
+		ReadTimeout:    config.Collection.ReadTimeout,
+		Retries:        config.Collection.ReadRetries,
+	}
+	scheduler := device.NewScheduler(devices, retryPolicy, config.Collection.Interval, config.Collection.StaleAfter)
 	// Forces re-discovery after a given period of time
 	reloadTimer := time.NewTimer(config.Collection.DiscoveryInterval)
 	tickTimer := time.NewTicker(config.Collection.Interval)
 	for {
-		/*
-			batch, err := client.NewBatchPoints(client.BatchPointsConfig{
-				Database:  config.Influx.Database,
-				Precision: "s",
-			})
-			if err != nil {
-				logger.WithError(err).Error("Failed to create point batch configuration")
-				errChan <- err
-				return
-			}
-		*/
-		for _, device := range devices {
-			readings, err := device.FetchReadings()
-			if err != nil {
-				device.Logger.WithError(err).Error("Failed to fetch readings from device")
-				continue
+		scheduler.RunOnce(ctx, onResult)
+		if onFlush != nil {
+			if err := onFlush(ctx); err != nil {
+				logger.WithError(err).Error("Failed to flush readings to the output sink")
 			}
-			device.Logger.Infof("Received readings: %s", readings)
-			/*
-				tags := map[string]string{
-					tagManufacturer: device.RootDevice.Device.Manufacturer,
-					tagModel:        device.RootDevice.Device.ModelName,
-					tagHost:         device.RootDevice.URLBase.Hostname(),
-					tagUDN:          device.RootDevice.Device.UDN,
-				}
-				pt, err := client.NewPoint(config.Influx.MeasurementName, tags, readings.ToInfluxValues(), time.Now())
-				if err != nil {
-					device.Logger.WithError(err).Error("Failed to create data point for measurements")
-				}
-				batch.AddPoint(pt)
-			*/
 		}
-		/*
-			logger.Info("Exporting batch data to InfluxDB")
-			// Send the collected info to Influx
-			if err = influxClient.Write(batch); err != nil {
-				logger.WithError(err).Error("Failed to upload data to InfluxDB")
-			} else {
-				logger.Info("Batch successfully uploaded")
-			}
-		*/
 		// And now we'll wait
 		select {
 		case <-reloadTimer.C:
@@ -93,6 +73,31 @@ func discoverAndRun(errChan chan error, config *Configuration, influxClient clie
 	}
 }
 
+// runCollectionLoop (re-)starts discoverAndRun whenever it stops - either because its discovery
+// interval elapsed or because discovery failed - until a termination signal is received, at which
+// point onShutdown is called to release any resources held by the caller
+func runCollectionLoop(config *Configuration, backend device.Backend, metadataCache *device.MetadataCache, onResult func(device.Result), onFlush func(context.Context) error, onShutdown func(), logger *logrus.Entry) {
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		errChan := make(chan error)
+		go discoverAndRun(errChan, config, backend, metadataCache, onResult, onFlush, logger)
+		select {
+		case err, ok := <-errChan:
+			if ok {
+				// An error occured - slow down the device discovery a bit
+				logger.WithError(err).Errorf("Re-scheduling discovery in %s", config.Collection.DiscoveryCooldown)
+				time.Sleep(config.Collection.DiscoveryCooldown)
+			}
+			logger.Info("Restarting discovery")
+		case sig := <-shutdown:
+			logger.Infof("Got signal to stop (%s). Shutting down", sig)
+			onShutdown()
+			return
+		}
+	}
+}
+
 func main() {
 	configFileName := flag.String("c", fmt.Sprintf("/etc/%[1]s/%[1]s.conf", appName), "Configuration file to load")
 	dumpDefaultConfiguration := flag.Bool("dump", false, "Dump the default configuration to stdout. Useful for creating a config file")
@@ -113,35 +118,82 @@ func main() {
 		logger.Fatalf("Failed to load configuration: %+v", err)
 	}
 
-	// Influx client
-	iConfig := client.HTTPConfig{
-		Addr: config.Influx.Addr,
+	backend, err := device.NewBackend(config.Collection.BLEBackend)
+	if err != nil {
+		logger.Fatalf("Failed to create BLE backend: %+v", err)
 	}
-	if config.Influx.Username != "" {
-		iConfig.Username = config.Influx.Username
-		iConfig.Password = config.Influx.Password
+
+	// Shared across re-discoveries so cached metadata survives longer than a single discovery cycle
+	metadataCache := device.NewMetadataCache(config.Collection.MetadataTTL)
+
+	if config.Collection.Mode == CollectionModeScrape {
+		collector := metrics.NewCollector()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", collector)
+		go func() {
+			if err := http.ListenAndServe(config.Collection.ScrapeAddr, mux); err != nil {
+				logger.WithError(err).Fatal("Metrics server failed")
+			}
+		}()
+		logger.Infof("Serving Prometheus metrics on %s/metrics", config.Collection.ScrapeAddr)
+		onResult := func(res device.Result) {
+			if res.Err != nil {
+				res.Device.Logger.WithError(res.Err).Error("Failed to fetch readings from device")
+			} else {
+				res.Device.Logger.Infof("Received readings: %s", res.Readings)
+			}
+			collector.Update(res.Device, res.Readings, res.Err)
+		}
+		runCollectionLoop(config, backend, metadataCache, onResult, nil, func() {}, logger)
+		return
 	}
-	influxClient, err := client.NewHTTPClient(iConfig)
+
+	sink, err := output.NewSink(
+		config.Output.Type,
+		output.InfluxConfig{
+			Addr:            config.Influx.Addr,
+			Username:        config.Influx.Username,
+			Password:        config.Influx.Password,
+			Database:        config.Influx.Database,
+			MeasurementName: config.Influx.MeasurementName,
+			BufferSize:      config.Influx.BufferSize,
+		},
+		output.MQTTConfig{
+			BrokerHost:      config.Output.BrokerHost,
+			BrokerUser:      config.Output.BrokerUser,
+			BrokerPassword:  config.Output.BrokerPassword,
+			UseTLS:          config.Output.UseTLS,
+			TopicPrefix:     config.Output.TopicPrefix,
+			PayloadFormat:   config.Output.PayloadFormat,
+			MeasurementName: config.Influx.MeasurementName,
+		},
+	)
 	if err != nil {
-		logger.Fatalf("Failed to create InfluxDB client: %+v", err)
+		logger.Fatalf("Failed to create output sink: %+v", err)
 	}
-	shutdown := make(chan os.Signal)
-	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
-	for {
-		errChan := make(chan error)
-		go discoverAndRun(errChan, config, influxClient, logger)
-		select {
-		case err, ok := <-errChan:
-			if ok {
-				// An error occured - slow down the device discovery a bit
-				logger.WithError(err).Error("Re-scheduling discovery in 10 seconds")
-				time.Sleep(config.Collection.DiscoveryCooldown)
+
+	onResult := func(res device.Result) {
+		tags := map[string]string{
+			tagMAC: res.Device.GetID(),
+		}
+		if res.Device.Alias != "" {
+			tags[tagAlias] = res.Device.Alias
+		}
+		if res.Err != nil {
+			res.Device.Logger.WithError(res.Err).Error("Failed to fetch readings from device")
+			if res.Stale {
+				res.Device.Logger.Warn("Device has missed too many consecutive reads and is considered stale")
+				if err := sink.Publish(context.Background(), res.Device.GetID(), tags, map[string]interface{}{"stale": 1}); err != nil {
+					res.Device.Logger.WithError(err).Error("Failed to publish stale marker")
+				}
 			}
-			logger.Info("Restarting discovery")
-		case sig := <-shutdown:
-			logger.Infof("Got signal to stop (%s). Shutting down", sig)
-			influxClient.Close()
 			return
 		}
+		res.Device.Logger.Infof("Received readings: %s", res.Readings)
+		tags[tagFirmwareVersion] = res.Readings.FirmwareVersion
+		if err := sink.Publish(context.Background(), res.Device.GetID(), tags, res.Readings.ToInfluxValues()); err != nil {
+			res.Device.Logger.WithError(err).Error("Failed to publish readings")
+		}
 	}
+	runCollectionLoop(config, backend, metadataCache, onResult, sink.Flush, func() { sink.Close() }, logger)
 }
@@ -0,0 +1,165 @@
+// Package metrics implements a Prometheus-compatible `/metrics` exporter for scrape mode. It caches
+// the latest reading obtained for each device so the HTTP handler can serve a scrape without ever
+// touching the BLE adapter itself - that only ever happens on the background collection ticker
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derWhity/flora2influx/device"
+	"github.com/derWhity/flora2influx/device/miflora"
+)
+
+// Metric names exposed at `/metrics`
+const (
+	metricTemperature       = "miflora_temperature_celsius"
+	metricMoisture          = "miflora_moisture_percent"
+	metricConductivity      = "miflora_conductivity_us_cm"
+	metricLight             = "miflora_light_lux"
+	metricBattery           = "miflora_battery_percent"
+	metricRSSI              = "miflora_rssi_dbm"
+	metricLastReadTimestamp = "miflora_last_read_timestamp_seconds"
+	metricReadErrorsTotal   = "miflora_read_errors_total"
+)
+
+// metricFamily describes one Prometheus metric family exposed at `/metrics`, including how to pull
+// its current value out of a deviceState. value returns ok=false when the metric has no sample yet
+// for that device (e.g. no reading has been collected), in which case the family skips it
+type metricFamily struct {
+	name  string
+	typ   string
+	help  string
+	value func(st *deviceState) (float64, bool)
+}
+
+// metricFamilies lists every metric family in the exact order they are rendered. Each family is
+// written as a contiguous block with its own `# HELP`/`# TYPE` lines, as required by the Prometheus
+// text exposition format
+var metricFamilies = []metricFamily{
+	{metricTemperature, "gauge", "Last measured temperature in degrees Celsius", func(st *deviceState) (float64, bool) {
+		if st.readings == nil {
+			return 0, false
+		}
+		return st.readings.Temperature, true
+	}},
+	{metricMoisture, "gauge", "Last measured soil moisture in percent", func(st *deviceState) (float64, bool) {
+		if st.readings == nil {
+			return 0, false
+		}
+		return float64(st.readings.Moisture), true
+	}},
+	{metricConductivity, "gauge", "Last measured soil conductivity in uS/cm", func(st *deviceState) (float64, bool) {
+		if st.readings == nil {
+			return 0, false
+		}
+		return float64(st.readings.Conductivity), true
+	}},
+	{metricLight, "gauge", "Last measured light intensity in lux", func(st *deviceState) (float64, bool) {
+		if st.readings == nil {
+			return 0, false
+		}
+		return float64(st.readings.Light), true
+	}},
+	{metricBattery, "gauge", "Last reported battery level in percent", func(st *deviceState) (float64, bool) {
+		if st.readings == nil {
+			return 0, false
+		}
+		return float64(st.readings.BatteryLevel), true
+	}},
+	{metricRSSI, "gauge", "RSSI of the last successful read in dBm", func(st *deviceState) (float64, bool) {
+		if st.readings == nil {
+			return 0, false
+		}
+		return float64(st.readings.RSSI), true
+	}},
+	{metricLastReadTimestamp, "gauge", "Unix timestamp of the last successful read", func(st *deviceState) (float64, bool) {
+		if st.readings == nil {
+			return 0, false
+		}
+		return float64(st.lastReadAt.Unix()), true
+	}},
+	{metricReadErrorsTotal, "counter", "Total number of reads that failed after all retries", func(st *deviceState) (float64, bool) {
+		return float64(st.readErrors), true
+	}},
+}
+
+// deviceState holds everything known about a single device since it was last seen
+type deviceState struct {
+	mac        string
+	alias      string
+	firmware   string
+	readings   *miflora.Readings
+	lastReadAt time.Time
+	readErrors int
+}
+
+// Collector caches the most recently collected Readings per device and renders them in the
+// Prometheus text exposition format on every scrape
+type Collector struct {
+	mu    sync.Mutex
+	state map[string]*deviceState
+}
+
+// NewCollector creates an empty Collector
+func NewCollector() *Collector {
+	return &Collector{state: map[string]*deviceState{}}
+}
+
+// Update records the outcome of a single collection attempt for dev, so the next scrape reflects
+// it. readings is nil when readErr is set
+func (c *Collector) Update(dev *device.Device, readings *miflora.Readings, readErr error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, ok := c.state[dev.GetID()]
+	if !ok {
+		st = &deviceState{mac: dev.GetID()}
+		c.state[dev.GetID()] = st
+	}
+	st.alias = dev.Alias
+	if readErr != nil {
+		st.readErrors++
+		return
+	}
+	st.firmware = readings.FirmwareVersion
+	st.readings = readings
+	st.lastReadAt = time.Now()
+}
+
+// ServeHTTP implements http.Handler, rendering the cached state of every known device in the
+// Prometheus text exposition format
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.state))
+	for id := range c.state {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b strings.Builder
+	for _, fam := range metricFamilies {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", fam.name, fam.help, fam.name, fam.typ)
+		for _, id := range ids {
+			st := c.state[id]
+			value, ok := fam.value(st)
+			if !ok {
+				continue
+			}
+			labels := fmt.Sprintf("mac=%q,alias=%q,firmware=%q", st.mac, st.alias, st.firmware)
+			writeSample(&b, fam.name, labels, value)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+func writeSample(b *strings.Builder, name, labels string, value float64) {
+	fmt.Fprintf(b, "%s{%s} %s\n", name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derWhity/flora2influx/device/miflora"
+)
+
+func TestServeHTTPGroupsSamplesByFamily(t *testing.T) {
+	c := NewCollector()
+	c.state["aa:bb:cc:dd:ee:ff"] = &deviceState{
+		mac:        "aa:bb:cc:dd:ee:ff",
+		alias:      "Living Room",
+		firmware:   "3.2.1",
+		readings:   &miflora.Readings{Temperature: 21.5},
+		lastReadAt: time.Unix(1000, 0),
+		readErrors: 2,
+	}
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, name := range []string{metricTemperature, metricReadErrorsTotal} {
+		occurrences := strings.Count(body, name+"{")
+		if occurrences != 1 {
+			t.Errorf("metric %s: expected a single contiguous sample line, found %d occurrences", name, occurrences)
+		}
+		if !regexp.MustCompile(`(?m)^# TYPE ` + name + ` (gauge|counter)$`).MatchString(body) {
+			t.Errorf("metric %s: missing # TYPE line", name)
+		}
+	}
+
+	if !strings.Contains(body, "# TYPE "+metricReadErrorsTotal+" counter") {
+		t.Errorf("expected %s to be typed as a counter, got body:\n%s", metricReadErrorsTotal, body)
+	}
+}
@@ -0,0 +1,147 @@
+package output
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/pkg/errors"
+)
+
+// writeRetries is the number of additional write attempts made after an initial failed write
+const writeRetries = 3
+
+// writeBackoffBase is the delay before the first write retry, doubling on every further attempt
+const writeBackoffBase = 500 * time.Millisecond
+
+// writeBackoffMax caps the delay between write retries
+const writeBackoffMax = 10 * time.Second
+
+// defaultBufferSize is the number of unsent batches kept in memory when InfluxConfig.BufferSize is
+// left at its zero value
+const defaultBufferSize = 10
+
+// InfluxConfig configures an InfluxHTTPSink
+type InfluxConfig struct {
+	// Address the InfluxDB instance is listening at
+	Addr string
+	// Optional user name for authentication
+	Username string
+	// Optional password for authentication
+	Password string
+	// The database to use (has to exist!)
+	Database string
+	// The name of the measurement to write into
+	MeasurementName string
+	// BufferSize is the number of unsent batches kept in memory across InfluxDB outages. Left at
+	// zero, defaultBufferSize is used
+	BufferSize int
+}
+
+// InfluxHTTPSink publishes readings to an InfluxDB instance over its HTTP API. Readings are
+// collected into one batch per collection tick and written out on Flush, so every device ends up
+// tagged and written together rather than point-by-point
+type InfluxHTTPSink struct {
+	client client.Client
+	config InfluxConfig
+
+	mu       sync.Mutex
+	pending  []*client.Point   // points collected for the batch currently being built
+	buffered [][]*client.Point // batches that failed to write and are waiting for a retry, oldest first
+}
+
+// NewInfluxHTTPSink creates an InfluxHTTPSink connected to the InfluxDB instance described by config
+func NewInfluxHTTPSink(config InfluxConfig) (*InfluxHTTPSink, error) {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultBufferSize
+	}
+	httpConfig := client.HTTPConfig{Addr: config.Addr}
+	if config.Username != "" {
+		httpConfig.Username = config.Username
+		httpConfig.Password = config.Password
+	}
+	c, err := client.NewHTTPClient(httpConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create InfluxDB client")
+	}
+	return &InfluxHTTPSink{client: c, config: config}, nil
+}
+
+// Publish implements Sink. It only adds a point to the batch being built for the current
+// collection tick - the actual write happens in Flush
+func (s *InfluxHTTPSink) Publish(ctx context.Context, deviceID string, tags map[string]string, readings map[string]interface{}) error {
+	pt, err := client.NewPoint(s.config.MeasurementName, tags, readings, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "Failed to create data point for measurements")
+	}
+	s.mu.Lock()
+	s.pending = append(s.pending, pt)
+	s.mu.Unlock()
+	return nil
+}
+
+// Flush implements Sink. It writes the batch collected since the last Flush to InfluxDB, retrying
+// with an exponential backoff on failure. Batches that still fail after all retries are kept
+// in memory (up to InfluxConfig.BufferSize) and re-attempted, oldest first, on the next Flush that
+// succeeds - so a brief InfluxDB outage does not lose readings
+func (s *InfluxHTTPSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	if len(s.pending) > 0 {
+		s.buffered = append(s.buffered, s.pending)
+		s.pending = nil
+		if overflow := len(s.buffered) - s.config.BufferSize; overflow > 0 {
+			s.buffered = s.buffered[overflow:]
+		}
+	}
+	batches := s.buffered
+	s.mu.Unlock()
+
+	written := 0
+	var err error
+	for _, points := range batches {
+		if err = s.writeWithRetry(points); err != nil {
+			break
+		}
+		written++
+	}
+	s.mu.Lock()
+	s.buffered = s.buffered[written:]
+	s.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "Failed to upload data to InfluxDB")
+	}
+	return nil
+}
+
+// writeWithRetry writes points as a single batch, retrying up to writeRetries times with an
+// exponential backoff between attempts
+func (s *InfluxHTTPSink) writeWithRetry(points []*client.Point) error {
+	batch, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:  s.config.Database,
+		Precision: "s",
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to create point batch")
+	}
+	batch.AddPoints(points)
+	var lastErr error
+	for attempt := 0; attempt <= writeRetries; attempt++ {
+		if attempt > 0 {
+			backoff := writeBackoffBase * time.Duration(1<<uint(attempt-1))
+			if backoff > writeBackoffMax {
+				backoff = writeBackoffMax
+			}
+			time.Sleep(backoff)
+		}
+		if lastErr = s.client.Write(batch); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// Close implements Sink
+func (s *InfluxHTTPSink) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,166 @@
+package output
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// Payload format names accepted for `output.payloadFormat`
+const (
+	// PayloadFormatGraphite emits one message per metric in Graphite's plaintext protocol
+	PayloadFormatGraphite = "graphite"
+	// PayloadFormatInfluxLine emits one message per device in InfluxDB line protocol
+	PayloadFormatInfluxLine = "influx-line"
+)
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// tagEscaper escapes the characters InfluxDB line protocol treats as syntax in tag keys and values:
+// commas, equals signs and spaces. See https://docs.influxdata.com/influxdb/v1.8/write_protocols/line_protocol_reference/#special-characters
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// MQTTConfig configures an MQTTSink
+type MQTTConfig struct {
+	// BrokerHost is the host:port of the MQTT broker to publish to
+	BrokerHost string
+	// Optional user name for authentication against the broker
+	BrokerUser string
+	// Optional password for authentication against the broker
+	BrokerPassword string
+	// UseTLS connects to the broker via TLS
+	UseTLS bool
+	// TopicPrefix is prepended to every topic this sink publishes to
+	TopicPrefix string
+	// PayloadFormat selects the message format: PayloadFormatGraphite or PayloadFormatInfluxLine
+	PayloadFormat string
+	// MeasurementName is used as the measurement name for the PayloadFormatInfluxLine format
+	MeasurementName string
+}
+
+// MQTTSink publishes readings to an MQTT broker - either as one Graphite-style message per metric,
+// or as a single InfluxDB line-protocol message per device - so they can be picked up by existing
+// Mosquitto/Telegraf/Home Assistant pipelines without running InfluxDB
+type MQTTSink struct {
+	client mqtt.Client
+	config MQTTConfig
+}
+
+// NewMQTTSink creates an MQTTSink connected to the broker described by config
+func NewMQTTSink(config MQTTConfig) (*MQTTSink, error) {
+	scheme := "tcp"
+	if config.UseTLS {
+		scheme = "ssl"
+	}
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("%s://%s", scheme, config.BrokerHost))
+	if config.UseTLS {
+		opts.SetTLSConfig(&tls.Config{})
+	}
+	if config.BrokerUser != "" {
+		opts.SetUsername(config.BrokerUser)
+		opts.SetPassword(config.BrokerPassword)
+	}
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return nil, errors.Wrap(token.Error(), "Failed to connect to MQTT broker")
+	}
+	return &MQTTSink{client: c, config: config}, nil
+}
+
+// Publish implements Sink
+func (s *MQTTSink) Publish(ctx context.Context, deviceID string, tags map[string]string, readings map[string]interface{}) error {
+	if s.config.PayloadFormat == PayloadFormatInfluxLine {
+		return s.publishInfluxLine(deviceID, tags, readings)
+	}
+	return s.publishGraphite(deviceID, readings)
+}
+
+// publishGraphite emits one message per metric as `<prefix>.miflora.<alphanumeric-id>.<metric> <value> <unix-ts>`
+// to the topic `<prefix>/<deviceID>/<metric>`
+func (s *MQTTSink) publishGraphite(deviceID string, readings map[string]interface{}) error {
+	ts := time.Now().Unix()
+	id := nonAlphanumeric.ReplaceAllString(deviceID, "")
+	for metric, value := range readings {
+		topic := fmt.Sprintf("%s/%s/%s", s.config.TopicPrefix, deviceID, metric)
+		payload := fmt.Sprintf("%s.miflora.%s.%s %v %d", s.config.TopicPrefix, id, metric, value, ts)
+		if token := s.client.Publish(topic, 0, false, payload); token.Wait() && token.Error() != nil {
+			return errors.Wrap(token.Error(), "Failed to publish MQTT message")
+		}
+	}
+	return nil
+}
+
+// publishInfluxLine emits a single message as `measurement,tag=... field=...i <ts_ns>` to the
+// topic `<prefix>/<deviceID>`
+func (s *MQTTSink) publishInfluxLine(deviceID string, tags map[string]string, readings map[string]interface{}) error {
+	topic := fmt.Sprintf("%s/%s", s.config.TopicPrefix, deviceID)
+	payload := fmt.Sprintf("%s,%s %s %d", s.config.MeasurementName, formatTags(tags), formatFields(readings), time.Now().UnixNano())
+	if token := s.client.Publish(topic, 0, false, payload); token.Wait() && token.Error() != nil {
+		return errors.Wrap(token.Error(), "Failed to publish MQTT message")
+	}
+	return nil
+}
+
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", tagEscaper.Replace(k), tagEscaper.Replace(tags[k])))
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatFields(readings map[string]interface{}) string {
+	keys := make([]string, 0, len(readings))
+	for k := range readings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, formatLineValue(readings[k])))
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatLineValue renders a single reading value in InfluxDB line protocol syntax: integers are
+// suffixed with "i", strings are quoted, floats and booleans are rendered as-is. Any other type is
+// formatted as an integer with the "i" suffix
+func formatLineValue(v interface{}) string {
+	switch val := v.(type) {
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32)
+	case bool:
+		return strconv.FormatBool(val)
+	case string:
+		return strconv.Quote(val)
+	default:
+		return fmt.Sprintf("%di", val)
+	}
+}
+
+// Flush implements Sink. It is a no-op since publishInfluxLine/publishGraphite already send each
+// reading as soon as it is published
+func (s *MQTTSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Sink
+func (s *MQTTSink) Close() error {
+	s.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,15 @@
+package output
+
+import "testing"
+
+func TestFormatTagsEscapesSpecialCharacters(t *testing.T) {
+	tags := map[string]string{
+		"alias": "Living Room",
+		"mac":   "aa:bb=cc,dd",
+	}
+	got := formatTags(tags)
+	want := `alias=Living\ Room,mac=aa:bb\=cc\,dd`
+	if got != want {
+		t.Errorf("formatTags(%v) = %q, want %q", tags, got, want)
+	}
+}
@@ -0,0 +1,41 @@
+// Package output implements the publishing side of flora2influx: turning one device's readings
+// into a message for an external time-series system
+package output
+
+import (
+	"context"
+	"fmt"
+)
+
+// Output type names accepted for `output.type`
+const (
+	// TypeInflux selects the InfluxHTTPSink
+	TypeInflux = "influx"
+	// TypeMQTT selects the MQTTSink
+	TypeMQTT = "mqtt"
+)
+
+// Sink publishes the readings collected from one device during one collection tick to an
+// external system
+type Sink interface {
+	// Publish sends one set of readings for deviceID, tagged with tags, to the sink's destination
+	Publish(ctx context.Context, deviceID string, tags map[string]string, readings map[string]interface{}) error
+	// Flush is called once all devices have been published for the current collection tick, giving
+	// the sink a chance to write out anything it only collects rather than sends immediately
+	Flush(ctx context.Context) error
+	// Close releases any resources held by the sink (network connections, etc.)
+	Close() error
+}
+
+// NewSink creates the Sink implementation selected by outputType. An empty outputType selects
+// TypeInflux
+func NewSink(outputType string, influxConf InfluxConfig, mqttConf MQTTConfig) (Sink, error) {
+	switch outputType {
+	case "", TypeInflux:
+		return NewInfluxHTTPSink(influxConf)
+	case TypeMQTT:
+		return NewMQTTSink(mqttConf)
+	default:
+		return nil, fmt.Errorf("Unknown output type %q", outputType)
+	}
+}